@@ -0,0 +1,81 @@
+package relay
+
+// Relay is implemented by every relay transport (currently just HTTP).
+type Relay interface {
+	Name() string
+	Run() error
+	Stop() error
+}
+
+// HTTPConfig describes one HTTP relay: the address it listens on, the
+// backends it fans writes out to, and the backends it proxies queries to.
+type HTTPConfig struct {
+	Name                   string
+	Addr                   string
+	SSLCombinedPem         string
+	DefaultRetentionPolicy string
+
+	Outputs []HTTPOutputConfig
+	Queries []HTTPQueryConfig
+
+	// Mode selects how writes fan out across Outputs: "replicate" (the
+	// default) sends every point to every backend; "shard" routes each
+	// point to a rendezvous-hashed subset of size ReplicationFactor;
+	// "shard-and-replicate" does the latter plus an async copy to every
+	// backend in Replicas. See outputMode in shard.go.
+	Mode              string
+	ReplicationFactor int
+	Replicas          []HTTPOutputConfig
+
+	// RateLimit gates serveWrite admission with a token bucket per
+	// Authorization principal and per source IP. See rateLimiter in
+	// ratelimit.go.
+	RateLimit HTTPRateLimitConfig
+}
+
+// HTTPRateLimitConfig is the global rate-limit rule plus optional
+// per-database overrides.
+type HTTPRateLimitConfig struct {
+	RatePerSecond float64
+	Burst         float64
+	PerDatabase   map[string]HTTPRateLimitRule
+}
+
+// HTTPRateLimitRule is a per-database override of HTTPRateLimitConfig's
+// global RatePerSecond/Burst.
+type HTTPRateLimitRule struct {
+	RatePerSecond float64
+	Burst         float64
+}
+
+// HTTPOutputConfig is one write backend: where to send writes, and how to
+// buffer/retry them if the backend is slow or unavailable.
+type HTTPOutputConfig struct {
+	Name                string
+	Location            string
+	Timeout             string
+	SkipTLSVerification bool
+
+	// BufferSizeMB enables a retryBuffer for this backend when non-zero;
+	// MaxDelayInterval/MaxBatchKB tune its retry/batching behavior.
+	BufferSizeMB     int
+	MaxDelayInterval string
+	MaxBatchKB       int
+
+	// Persistent backends journal queued writes to a diskWAL under
+	// BufferDir (namespaced by Name) so they survive a relay restart.
+	Persistent bool
+	BufferDir  string
+
+	// HighWaterMarkMB rejects writes to this backend once its retryBuffer
+	// has this many MB queued, rather than blocking or unboundedly
+	// growing. Zero disables the check.
+	HighWaterMarkMB int
+}
+
+// HTTPQueryConfig is one query backend that /query reads are proxied to.
+type HTTPQueryConfig struct {
+	Name     string
+	Location string
+	Timeout  string
+}
@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"crypto/tls"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fasthttpPoster posts batches to a single backend location over a
+// pipelining fasthttp client, reusing pooled Request/Response objects.
+// That avoids the *fasthttp.Request/Response allocations a one-shot
+// fasthttp.Do would incur, but post() itself is not allocation-free: the
+// response body must be copied out before the pooled Response is
+// released, and the returned *responseData necessarily escapes to the
+// heap. See BenchmarkFasthttpPosterPost for the current allocation count.
+type fasthttpPoster struct {
+	client   *fasthttp.PipelineClient
+	location string
+	timeout  time.Duration
+}
+
+func newFasthttpPoster(location string, timeout time.Duration, skipTLSVerification bool) (*fasthttpPoster, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &fasthttp.PipelineClient{
+		Addr:         u.Host,
+		IsTLS:        u.Scheme == "https",
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: skipTLSVerification,
+		},
+	}
+
+	return &fasthttpPoster{
+		client:   client,
+		location: location,
+		timeout:  timeout,
+	}, nil
+}
+
+func (b *fasthttpPoster) post(buf []byte, query string, auth string) (*responseData, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod("POST")
+	req.SetRequestURI(b.location + "?" + query)
+	req.Header.SetContentType("text/plain")
+	req.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.SetBody(buf)
+
+	if err := b.client.Do(req, resp); err != nil {
+		return nil, err
+	}
+
+	// resp (and its body buffer) is returned to the pool on defer above,
+	// so the body must be copied out before this function returns.
+	body := make([]byte, len(resp.Body()))
+	copy(body, resp.Body())
+
+	return &responseData{
+		ContentType:     string(resp.Header.ContentType()),
+		ContentEncoding: string(resp.Header.ContentEncoding()),
+		StatusCode:      resp.StatusCode(),
+		Body:            body,
+	}, nil
+}
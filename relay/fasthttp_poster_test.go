@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func startTestServer(t testing.TB) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
+		},
+	}
+
+	go server.Serve(ln)
+
+	return ln.Addr().String(), func() {
+		server.Shutdown()
+	}
+}
+
+func TestFasthttpPosterPost(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	p, err := newFasthttpPoster(fmt.Sprintf("http://%s/write", addr), 0, false)
+	if err != nil {
+		t.Fatalf("newFasthttpPoster: %v", err)
+	}
+
+	resp, err := p.post([]byte("m,t=v f=1 1\n"), "db=x", "")
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	if resp.StatusCode != fasthttp.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+}
+
+// BenchmarkFasthttpPosterPost measures the steady-state allocation cost of
+// post(), per the review that flagged the earlier "no heap allocations"
+// doc comment as an unsubstantiated claim. It is not zero - the response
+// body copy and the returned *responseData both escape to the heap - but
+// pooling the fasthttp Request/Response keeps the count small and
+// constant regardless of traffic, rather than growing with backend churn.
+func BenchmarkFasthttpPosterPost(b *testing.B) {
+	addr, stop := startTestServer(b)
+	defer stop()
+
+	p, err := newFasthttpPoster(fmt.Sprintf("http://%s/write", addr), 0, false)
+	if err != nil {
+		b.Fatalf("newFasthttpPoster: %v", err)
+	}
+
+	buf := []byte("m,t=v f=1 1\n")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := p.post(buf, "db=x", ""); err != nil {
+			b.Fatalf("post: %v", err)
+		}
+	})
+	b.ReportMetric(allocs, "allocs/op")
+}
@@ -1,23 +1,24 @@
 package relay
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
-	"net/http"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"math/rand"
-
 	"github.com/influxdata/influxdb/models"
+	"github.com/valyala/fasthttp"
 )
 
 // HTTP is a relay for HTTP influxdb writes
@@ -35,6 +36,19 @@ type HTTP struct {
 	backends []*httpBackend
 
 	queries []*httpBackend
+
+	// mode governs how serveWrite fans a write out across backends:
+	// replicate (the default) sends every point to every backend, shard
+	// routes each point to a rendezvous-hashed subset, and
+	// shard-and-replicate does the latter plus an async copy to replicas.
+	mode              outputMode
+	replicationFactor int
+	replicas          []*httpBackend
+
+	// limiter gates serveWrite admission with a token bucket per
+	// Authorization principal and per source IP, with an optional
+	// per-database override. Nil/disabled limiter rules mean unlimited.
+	limiter *rateLimiter
 }
 
 const (
@@ -77,6 +91,36 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 		h.queries = append(h.queries, query_backend)
 	}
 
+	mode, err := parseOutputMode(cfg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	h.mode = mode
+
+	h.replicationFactor = cfg.ReplicationFactor
+	if h.replicationFactor < 1 {
+		h.replicationFactor = 1
+	}
+
+	if h.mode == modeShardAndReplicate {
+		for i := range cfg.Replicas {
+			replica, err := newHTTPBackend(&cfg.Replicas[i])
+			if err != nil {
+				return nil, err
+			}
+			h.replicas = append(h.replicas, replica)
+		}
+	}
+
+	perDB := make(map[string]rateLimitRule, len(cfg.RateLimit.PerDatabase))
+	for db, rule := range cfg.RateLimit.PerDatabase {
+		perDB[db] = rateLimitRule{RatePerSecond: rule.RatePerSecond, Burst: rule.Burst}
+	}
+	h.limiter = newRateLimiter(rateLimitRule{
+		RatePerSecond: cfg.RateLimit.RatePerSecond,
+		Burst:         cfg.RateLimit.Burst,
+	}, perDB)
+
 	return h, nil
 }
 
@@ -109,7 +153,15 @@ func (h *HTTP) Run() error {
 
 	log.Printf("Starting %s relay %q on %v", strings.ToUpper(h.schema), h.Name(), h.addr)
 
-	err = http.Serve(l, h)
+	server := &fasthttp.Server{
+		Handler: h.requestHandler,
+		// Stream the request body instead of fasthttp buffering it whole,
+		// so serveWrite's chunked reader keeps its O(chunk size) memory
+		// footprint for the request body too.
+		StreamRequestBody: true,
+	}
+
+	err = server.Serve(l)
 	if atomic.LoadInt64(&h.closing) != 0 {
 		return nil
 	}
@@ -121,282 +173,328 @@ func (h *HTTP) Stop() error {
 	return h.l.Close()
 }
 
-func (h *HTTP) servePing(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("X-InfluxDB-Version", "relay")
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func (h *HTTP) serveQuery(w http.ResponseWriter, r *http.Request) {
-	single_node_request := func(w http.ResponseWriter, r *http.Request) {
-		// use random query backend
-		rand.Seed(time.Now().UnixNano())
-		n := rand.Intn(len(h.queries))
-		resp, err := h.queries[n].poster.post(
-			[]byte(""),
-			r.URL.Query().Encode(),
-			r.Header.Get("Authorization"))
-
-		if err == nil {
-			for k, v := range resp.Headers {
-				w.Header().Set(k, v)
-			}
-			w.Write([]byte(resp.Body))
-		} else {
-			jsonError(w, http.StatusBadRequest, "request failed")
-		}
-	}
-
-	all_node_request := func(w http.ResponseWriter, r *http.Request) {
-		var resp *responseData
-		var err error
-		for _, q := range h.queries {
-			resp, err = q.poster.post(
-				[]byte{},
-				r.URL.Query().Encode(),
-				r.Header.Get("Authorization"))
-
-			if err == nil {
-				continue
-			}
-			// todo fix the partial success
-		}
-
-		if err == nil {
-			w.Write([]byte(resp.Body))
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-	}
-
-	error_request := func(w http.ResponseWriter, r *http.Request, token string) {
-		msg := "relay is not support `" + token + "` expr!"
-		jsonError(w, http.StatusBadRequest, msg)
-	}
-
-	q := strings.Trim(strings.ToUpper(r.URL.Query().Get("q")), " \t\r\n")
-	tokens := strings.Split(q, " ")
-	switch tokens[0] {
-	case "SELECT", "SHOW":
-		single_node_request(w, r) // proxy to one node is ok (ASSUME all backend have the same data)
-	case "DELETE", "DROP", "GRANT", "REVOKE", "ALTER", "SET", "CREATE":
-		all_node_request(w, r) // must proxy to all node
-	case "KILL":
-		error_request(w, r, tokens[0]) // not supported (we don't know the request should be proxy to which server)
+func (h *HTTP) requestHandler(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Path()) {
+	case "/ping":
+		h.servePing(ctx)
+	case "/query":
+		h.serveQuery(ctx)
+	case "/write":
+		h.serveWrite(ctx)
+	case "/metrics":
+		h.serveMetrics(ctx)
+	case "/debug/relay":
+		h.serveDebug(ctx)
 	default:
-		error_request(w, r, tokens[0]) // unknown command (direct return error)
+		jsonError(ctx, fasthttp.StatusNotFound, "invalid write endpoint")
 	}
 }
 
-func (h *HTTP) serveWrite(w http.ResponseWriter, r *http.Request) {
+func (h *HTTP) servePing(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set("X-InfluxDB-Version", "relay")
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// maxStreamChunkBytes bounds how many raw line-protocol bytes serveWrite
+// accumulates before validating and fanning the chunk out to the backends.
+// Keeping this small and fixed is what lets serveWrite hold O(chunk size)
+// rather than O(body size) of memory for a single write request.
+const maxStreamChunkBytes = DefaultBatchSizeKB * KB
+
+func (h *HTTP) serveWrite(ctx *fasthttp.RequestCtx) {
 	start := time.Now()
 
-	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
+	if !ctx.IsPost() {
+		ctx.Response.Header.Set("Allow", "POST")
+		if ctx.IsOptions() {
+			ctx.SetStatusCode(fasthttp.StatusNoContent)
 		} else {
-			jsonError(w, http.StatusMethodNotAllowed, "invalid write method")
+			jsonError(ctx, fasthttp.StatusMethodNotAllowed, "invalid write method")
 		}
 		return
 	}
 
-	queryParams := r.URL.Query()
+	queryArgs := ctx.QueryArgs()
 
 	// fail early if we're missing the database
-	if queryParams.Get("db") == "" {
-		jsonError(w, http.StatusBadRequest, "missing parameter: db")
+	db := string(queryArgs.Peek("db"))
+	if db == "" {
+		jsonError(ctx, fasthttp.StatusBadRequest, "missing parameter: db")
 		return
 	}
 
-	if queryParams.Get("rp") == "" && h.rp != "" {
-		queryParams.Set("rp", h.rp)
+	rp := string(queryArgs.Peek("rp"))
+	if rp == "" && h.rp != "" {
+		queryArgs.Set("rp", h.rp)
+		rp = h.rp
 	}
 
-	var body = r.Body
+	// check for authorization performed via the header
+	authHeader := string(ctx.Request.Header.Peek("Authorization"))
+
+	// Admission control: gate on the rate limiter before doing any work
+	// to read/parse the body, so an over-quota client is turned away as
+	// cheaply as possible.
+	if h.limiter.enabled() && !h.limiter.allow(db, authHeader, ctx.RemoteIP().String()) {
+		ctx.Response.Header.Set("Retry-After", "1")
+		jsonError(ctx, fasthttp.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+
+	var body io.Reader
+	if s := ctx.RequestBodyStream(); s != nil {
+		body = s
+	} else {
+		body = bytes.NewReader(ctx.PostBody())
+	}
 
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		b, err := gzip.NewReader(r.Body)
+	if string(ctx.Request.Header.Peek("Content-Encoding")) == "gzip" {
+		b, err := gzip.NewReader(body)
 		if err != nil {
-			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
+			jsonError(ctx, fasthttp.StatusBadRequest, "unable to decode gzip body")
+			return
 		}
 		defer b.Close()
 		body = b
 	}
 
-	bodyBuf := getBuf()
-	_, err := bodyBuf.ReadFrom(body)
-	if err != nil {
-		jsonError(w, http.StatusInternalServerError, "problem reading request body")
-		return
-	}
+	precision := string(queryArgs.Peek("precision"))
 
-	precision := queryParams.Get("precision")
-	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), start, precision)
-	if err != nil {
-		jsonError(w, http.StatusBadRequest, "unable to parse points")
-		return
+	// normalize query string
+	query := string(queryArgs.QueryString())
+
+	var wg sync.WaitGroup
+	var backpressure int32
+	dispatch := func(chunk []byte, targets []*httpBackend) {
+		for _, b := range targets {
+			b := b
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := b.post(chunk, query, authHeader)
+				if err == ErrBufferFull {
+					atomic.StoreInt32(&backpressure, 1)
+				} else if err != nil {
+					log.Printf("Problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
+				} else if resp.StatusCode/100 == 5 {
+					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
+				}
+			}()
+		}
 	}
 
-	outBuf := getBuf()
-	for _, p := range points {
-		if _, err = outBuf.WriteString(p.PrecisionString(precision)); err != nil {
-			break
+	// flush validates the accumulated chunk as a whole (the common, cheap
+	// path) and only re-walks it line-by-line to find the offending line
+	// once that validation actually fails.
+	//
+	// Because each chunk is dispatched to the backends as soon as it
+	// validates, a parse failure on a later chunk does NOT roll back
+	// chunks already sent - this mirrors InfluxDB's own httpd write
+	// handler, which accepts a "partial write" (valid points before the
+	// bad line are written) and reports 400 only for the line that
+	// failed. A client must not blindly retry the whole body on 400; the
+	// "lines 1-N accepted" count in the error tells it how much was already
+	// applied.
+	chunk := new(bytes.Buffer)
+	chunkStartLine := 0
+	chunkLines := 0
+	flush := func() error {
+		if chunk.Len() == 0 {
+			return nil
 		}
-		if err = outBuf.WriteByte('\n'); err != nil {
-			break
+
+		data := chunk.Bytes()
+		points, err := models.ParsePointsWithPrecision(data, start, precision)
+		var parseErr error
+		if err != nil {
+			lines := bytes.Split(data, []byte("\n"))
+			for i, line := range lines {
+				if len(bytes.TrimSpace(line)) == 0 {
+					continue
+				}
+				if _, lineErr := models.ParsePointsWithPrecision(line, start, precision); lineErr != nil {
+					parseErr = fmt.Errorf("partial write: lines 1-%d accepted, unable to parse line %d: %v", chunkStartLine+i, chunkStartLine+i+1, lineErr)
+					// The lines of this chunk ahead of the bad one are
+					// dispatched below, so they are accepted as reported.
+					data = append(bytes.Join(lines[:i], []byte("\n")), '\n')
+					points, err = models.ParsePointsWithPrecision(data, start, precision)
+					break
+				}
+			}
+			if parseErr == nil {
+				return fmt.Errorf("partial write: lines 1-%d accepted, unable to parse remaining points: %v", chunkStartLine, err)
+			}
+			if err != nil || len(points) == 0 {
+				return parseErr
+			}
 		}
-	}
 
-	if err != nil {
-		jsonError(w, http.StatusInternalServerError, "problem writing points")
-		return
-	}
+		if h.mode == modeReplicate {
+			buf := make([]byte, len(data))
+			copy(buf, data)
+			dispatch(buf, h.backends)
+		} else {
+			h.dispatchSharded(points, precision, db, rp, query, authHeader, dispatch)
+		}
 
-	// normalize query string
-	query := queryParams.Encode()
+		chunkStartLine += chunkLines
+		chunkLines = 0
+		chunk.Reset()
+		return parseErr
+	}
 
-	outBytes := outBuf.Bytes()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*KB), MB)
 
-	// check for authorization performed via the header
-	authHeader := r.Header.Get("Authorization")
+	for scanner.Scan() {
+		chunk.Write(scanner.Bytes())
+		chunk.WriteByte('\n')
+		chunkLines++
 
-	for _, b := range h.backends {
-		b := b
-		go func() {
-			resp, err := b.post(outBytes, query, authHeader)
-			if err != nil {
-				log.Printf("Problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
-			} else {
-				if resp.StatusCode/100 == 5 {
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
-				}
+		if chunk.Len() >= maxStreamChunkBytes {
+			if err := flush(); err != nil {
+				jsonError(ctx, fasthttp.StatusBadRequest, err.Error())
+				return
 			}
-		}()
+		}
 	}
 
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/ping":
-		h.servePing(w, r)
-	case "/query":
-		h.serveQuery(w, r)
-	case "/write":
-		h.serveWrite(w, r)
-	default:
-		jsonError(w, http.StatusNotFound, "invalid write endpoint")
+	if err := scanner.Err(); err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "problem reading request body")
+		return
 	}
-}
 
-type responseData struct {
-	Headers map[string]string
-	//ContentType        string
-	//ContentEncoding    string
-	//X-Influxdb-Version string
-	StatusCode int
-	Body       []byte
-}
-
-func (rd *responseData) Write(w http.ResponseWriter) {
-	if rd.Headers["ContentType"] != "" {
-		w.Header().Set("Content-Type", rd.Headers["ContentType"])
+	if err := flush(); err != nil {
+		jsonError(ctx, fasthttp.StatusBadRequest, err.Error())
+		return
 	}
 
-	if rd.Headers["ContentEncoding"] != "" {
-		w.Header().Set("Content-Encoding", rd.Headers["ContentEncoding"])
-	}
+	// Only acknowledge the write once every chunk's post to every backend
+	// has returned (either delivered, or queued in its retryBuffer). A post
+	// that fails other than with ErrBufferFull is logged and does not
+	// change the response.
+	wg.Wait()
 
-	w.Header().Set("Content-Length", strconv.Itoa(len(rd.Body)))
-	w.WriteHeader(rd.StatusCode)
-	w.Write(rd.Body)
-}
+	if atomic.LoadInt32(&backpressure) != 0 {
+		ctx.Response.Header.Set("Retry-After", "1")
+		jsonError(ctx, fasthttp.StatusTooManyRequests, "backend queue full, retry later")
+		return
+	}
 
-func jsonError(w http.ResponseWriter, code int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	data := fmt.Sprintf("{\"error\":%q}\n", message)
-	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
-	w.WriteHeader(code)
-	w.Write([]byte(data))
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
 }
 
-type poster interface {
-	post([]byte, string, string) (*responseData, error)
+type backendMetrics struct {
+	Name             string `json:"name"`
+	PendingItems     int    `json:"pendingItems"`
+	PendingBytes     int64  `json:"pendingBytes"`
+	OldestSegmentAge string `json:"oldestSegmentAge,omitempty"`
 }
 
-type simplePoster struct {
-	client   *http.Client
-	location string
+// statsPoster is implemented by posters that can report a queue backlog,
+// currently just retryBuffer. It backs the /metrics endpoint.
+type statsPoster interface {
+	stats() walMetrics
 }
 
-func newSimplePoster(location string, timeout time.Duration, skipTLSVerification bool) *simplePoster {
-	// Configure custom transport for http.Client
-	// Used for support skip-tls-verification option
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipTLSVerification,
-		},
+func (h *HTTP) serveMetrics(ctx *fasthttp.RequestCtx) {
+	metrics := make([]backendMetrics, 0, len(h.backends))
+	for _, b := range h.backends {
+		m := backendMetrics{Name: b.name}
+		if sp, ok := b.poster.(statsPoster); ok {
+			s := sp.stats()
+			m.PendingItems = s.PendingItems
+			m.PendingBytes = s.PendingBytes
+			if s.OldestSegmentAge > 0 {
+				m.OldestSegmentAge = s.OldestSegmentAge.String()
+			}
+		}
+		metrics = append(metrics, m)
 	}
 
-	return &simplePoster{
-		client: &http.Client{
-			Timeout:   timeout,
-			Transport: transport,
-		},
-		location: location,
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "unable to marshal metrics")
+		return
 	}
+
+	ctx.SetContentType("application/json")
+	ctx.Write(data)
 }
 
-func (b *simplePoster) post(buf []byte, query string, auth string) (*responseData, error) {
-	req, err := http.NewRequest("POST", b.location, bytes.NewReader(buf))
-	if err != nil {
-		return nil, err
-	}
+// relayDebugBackend is the fuller per-backend snapshot served on
+// /debug/relay, for operators tuning rate-limit/high-water-mark knobs:
+// queue depth, dropped-write counts and a delivery-latency histogram, on
+// top of what /metrics already reports.
+type relayDebugBackend struct {
+	Name             string          `json:"name"`
+	PendingItems     int             `json:"pendingItems"`
+	QueuedBytes      int64           `json:"queuedBytes"`
+	Dropped          int64           `json:"dropped"`
+	PendingBytes     int64           `json:"walPendingBytes,omitempty"`
+	OldestSegmentAge string          `json:"oldestSegmentAge,omitempty"`
+	Latency          latencySnapshot `json:"latency"`
+}
 
-	req.URL.RawQuery = query
-	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("Content-Length", strconv.Itoa(len(buf)))
-	if auth != "" {
-		req.Header.Set("Authorization", auth)
+func (h *HTTP) serveDebug(ctx *fasthttp.RequestCtx) {
+	backends := make([]relayDebugBackend, 0, len(h.backends))
+	for _, b := range h.backends {
+		d := relayDebugBackend{Name: b.name}
+		if sp, ok := b.poster.(statsPoster); ok {
+			s := sp.stats()
+			d.PendingItems = s.PendingItems
+			d.QueuedBytes = s.QueuedBytes
+			d.Dropped = s.Dropped
+			d.PendingBytes = s.PendingBytes
+			if s.OldestSegmentAge > 0 {
+				d.OldestSegmentAge = s.OldestSegmentAge.String()
+			}
+			d.Latency = s.Latency
+		}
+		backends = append(backends, d)
 	}
 
-	resp, err := b.client.Do(req)
+	data, err := json.Marshal(backends)
 	if err != nil {
-		return nil, err
+		jsonError(ctx, fasthttp.StatusInternalServerError, "unable to marshal debug info")
+		return
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	ctx.SetContentType("application/json")
+	ctx.Write(data)
+}
 
-	if err = resp.Body.Close(); err != nil {
-		return nil, err
+// responseData holds just the bits of a backend response callers actually
+// look at - concrete fields rather than a generic header map, so a
+// fasthttpPoster.post call doesn't need to allocate one.
+type responseData struct {
+	ContentType     string
+	ContentEncoding string
+	StatusCode      int
+	Body            []byte
+}
+
+func (rd *responseData) writeTo(ctx *fasthttp.RequestCtx) {
+	if rd.ContentType != "" {
+		ctx.SetContentType(rd.ContentType)
 	}
 
-	// for k, v := range resp.Header {
-	//
-	//   }
-	// Loop through headers
+	if rd.ContentEncoding != "" {
+		ctx.Response.Header.Set("Content-Encoding", rd.ContentEncoding)
+	}
 
-	m := make(map[string]string)
+	ctx.SetStatusCode(rd.StatusCode)
+	ctx.Write(rd.Body)
+}
 
-	for name, headers := range resp.Header {
-		name = strings.ToLower(name)
-		for _, h := range headers {
-			m[name] = h
-		}
-	}
+func jsonError(ctx *fasthttp.RequestCtx, code int, message string) {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(code)
+	fmt.Fprintf(ctx, "{\"error\":%q}\n", message)
+}
 
-	return &responseData{
-		Headers: m,
-		//ContentType:        resp.Header.Get("Content-Type"),
-		//ContentEncoding:    resp.Header.Get("Content-Encoding"),
-		//X-Influxdb-Version: resp.Header.Get("X-Influxdb-Version"),
-		StatusCode: resp.StatusCode,
-		Body:       data,
-	}, nil
+type poster interface {
+	post([]byte, string, string) (*responseData, error)
 }
 
 type httpBackend struct {
@@ -419,7 +517,10 @@ func newHttpQueryBackend(cfg *HTTPQueryConfig) (*httpBackend, error) {
 	}
 
 	// todo use config skipTLSVerification ?
-	var p poster = newSimplePoster(cfg.Location, timeout, true)
+	p, err := newFasthttpPoster(cfg.Location, timeout, true)
+	if err != nil {
+		return nil, err
+	}
 
 	return &httpBackend{
 		poster: p,
@@ -441,7 +542,12 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 		timeout = t
 	}
 
-	var p poster = newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+	var p poster
+	fp, err := newFasthttpPoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+	if err != nil {
+		return nil, err
+	}
+	p = fp
 
 	// If configured, create a retryBuffer per backend.
 	// This way we serialize retries against each backend.
@@ -460,7 +566,24 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 			batch = cfg.MaxBatchKB * KB
 		}
 
-		p = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
+		// Persistent backends journal to a diskWAL under BufferDir,
+		// keyed by backend name, so queued batches survive a restart.
+		var walDir string
+		if cfg.Persistent && cfg.BufferDir != "" {
+			walDir = filepath.Join(cfg.BufferDir, cfg.Name)
+		}
+
+		// A non-zero HighWaterMarkMB rejects writes with ErrBufferFull
+		// once this backend's queued bytes pass the mark, rather than
+		// letting retryBuffer's post() fall back to just the itemChan's
+		// fixed capacity.
+		highWaterMark := int64(cfg.HighWaterMarkMB) * MB
+
+		rb, err := newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p, walDir, highWaterMark)
+		if err != nil {
+			return nil, fmt.Errorf("error opening retry buffer for %q: %v", cfg.Name, err)
+		}
+		p = rb
 	}
 
 	return &httpBackend{
@@ -470,16 +593,3 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 }
 
 var ErrBufferFull = errors.New("retry buffer full")
-
-// use bufPool may lost data
-// var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
-
-// use bufPool may lost data
-func getBuf() *bytes.Buffer {
-	return bytes.NewBuffer(make([]byte, 2*KB))
-}
-
-// use bufPool may lost data
-func putBuf(b *bytes.Buffer) {
-	b.Reset()
-}
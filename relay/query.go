@@ -0,0 +1,548 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/valyala/fasthttp"
+)
+
+// influxQLResponse mirrors the JSON shape InfluxDB's own httpd handler
+// returns from /query, just enough of it for the relay to merge and
+// re-chunk results coming back from multiple query backends.
+type influxQLResponse struct {
+	Results []influxQLResult `json:"results"`
+}
+
+type influxQLResult struct {
+	StatementID int              `json:"statement_id"`
+	Series      []influxQLSeries `json:"series,omitempty"`
+	Err         string           `json:"error,omitempty"`
+	Partial     bool             `json:"partial,omitempty"`
+}
+
+type influxQLSeries struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns,omitempty"`
+	Values  [][]interface{}   `json:"values,omitempty"`
+}
+
+// isReadOnlyStatement reports whether stmt only reads data or schema, as
+// opposed to mutating it. Mirrors the statement kinds InfluxDB itself
+// treats as safe to serve from any shard.
+func isReadOnlyStatement(stmt influxql.Statement) bool {
+	switch stmt.(type) {
+	case *influxql.SelectStatement,
+		*influxql.ShowDatabasesStatement,
+		*influxql.ShowMeasurementsStatement,
+		*influxql.ShowRetentionPoliciesStatement,
+		*influxql.ShowSeriesStatement,
+		*influxql.ShowTagKeysStatement,
+		*influxql.ShowTagValuesStatement,
+		*influxql.ShowFieldKeysStatement,
+		*influxql.ShowStatsStatement,
+		*influxql.ShowDiagnosticsStatement,
+		*influxql.ShowSubscriptionsStatement,
+		*influxql.ShowContinuousQueriesStatement,
+		*influxql.ShowGrantsForUserStatement,
+		*influxql.ShowUsersStatement,
+		*influxql.ShowQueriesStatement,
+		*influxql.ShowShardsStatement,
+		*influxql.ShowShardGroupsStatement:
+		return true
+	default:
+		return false
+	}
+}
+
+// isShowStatement reports whether stmt is one of the SHOW statements whose
+// result can legitimately differ per backend (e.g. tag values, series) and
+// therefore needs merging rather than a single arbitrary backend's answer.
+func isShowStatement(stmt influxql.Statement) bool {
+	switch stmt.(type) {
+	case *influxql.ShowDatabasesStatement,
+		*influxql.ShowMeasurementsStatement,
+		*influxql.ShowRetentionPoliciesStatement,
+		*influxql.ShowSeriesStatement,
+		*influxql.ShowTagKeysStatement,
+		*influxql.ShowTagValuesStatement,
+		*influxql.ShowFieldKeysStatement,
+		*influxql.ShowStatsStatement,
+		*influxql.ShowDiagnosticsStatement,
+		*influxql.ShowSubscriptionsStatement,
+		*influxql.ShowContinuousQueriesStatement,
+		*influxql.ShowQueriesStatement,
+		*influxql.ShowShardsStatement,
+		*influxql.ShowShardGroupsStatement:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *HTTP) serveQuery(ctx *fasthttp.RequestCtx) {
+	q := string(ctx.QueryArgs().Peek("q"))
+
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("error parsing query: %v", err))
+		return
+	}
+
+	for _, stmt := range query.Statements {
+		if _, ok := stmt.(*influxql.KillQueryStatement); ok {
+			jsonError(ctx, fasthttp.StatusBadRequest, "relay does not support `KILL QUERY` (target server is unknown)")
+			return
+		}
+	}
+
+	hasRead := false
+	hasWrite := false
+	anyShow := false
+	for _, stmt := range query.Statements {
+		if isReadOnlyStatement(stmt) {
+			hasRead = true
+		} else {
+			hasWrite = true
+		}
+		if isShowStatement(stmt) {
+			anyShow = true
+		}
+	}
+
+	rawQuery := string(ctx.QueryArgs().QueryString())
+	auth := string(ctx.Request.Header.Peek("Authorization"))
+	chunked := string(ctx.QueryArgs().Peek("chunked")) == "true"
+	chunkSize, _ := strconv.Atoi(string(ctx.QueryArgs().Peek("chunk_size")))
+
+	// A query mixing a read with a write/DDL statement (e.g. "SELECT *
+	// FROM cpu; DROP MEASUREMENT cpu") can't be routed as a whole: the
+	// read needs an actual backend response merged in, while the write
+	// needs broadcasting. mixedQuery walks the statement list and routes
+	// each statement on its own.
+	if hasRead && hasWrite {
+		h.mixedQuery(ctx, query.Statements, auth, chunked, chunkSize)
+		return
+	}
+
+	if hasWrite {
+		h.broadcastQuery(ctx, rawQuery, auth, len(query.Statements))
+		return
+	}
+
+	if len(h.queries) == 0 {
+		jsonError(ctx, fasthttp.StatusServiceUnavailable, "no query backends configured")
+		return
+	}
+
+	// Once writes are sharded, no single query backend holds the full
+	// data set any more, so a plain SELECT needs the same per-backend
+	// fan-out and merge as a SHOW - singleQuery's "every backend has the
+	// same data" assumption only holds in modeReplicate.
+	if anyShow || h.mode != modeReplicate {
+		h.mergedQuery(ctx, rawQuery, auth, chunked, chunkSize)
+		return
+	}
+
+	h.singleQuery(ctx, rawQuery, auth, chunked, chunkSize)
+}
+
+// singleQuery proxies a read to one random query backend. Only safe in
+// modeReplicate, where every backend holds the same full data set -
+// serveQuery routes everywhere else through mergedQuery instead. When
+// chunked is requested the response is decoded and re-emitted in pages
+// rather than written out in one piece.
+func (h *HTTP) singleQuery(ctx *fasthttp.RequestCtx, query, auth string, chunked bool, chunkSize int) {
+	rand.Seed(time.Now().UnixNano())
+	n := rand.Intn(len(h.queries))
+
+	resp, err := h.queries[n].poster.post([]byte{}, query, auth)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusBadGateway, "request failed")
+		return
+	}
+
+	if !chunked {
+		resp.writeTo(ctx)
+		return
+	}
+
+	var decoded influxQLResponse
+	if err := json.Unmarshal(resp.Body, &decoded); err != nil {
+		ctx.Write(resp.Body)
+		return
+	}
+	writeChunkedQueryResponse(ctx, decoded, chunkSize)
+}
+
+// mergedQuery fans a read out to every query backend, merges the decoded
+// results (deduping series by name+tags and rows within a series), and
+// writes the merged response back, honoring chunked/chunk_size. This is
+// also the correct path once writes are sharded: each query backend then
+// holds only a subset of the data, so every backend must be queried and
+// the partial results merged, the same as for a SHOW whose answer can
+// legitimately differ per backend.
+func (h *HTTP) mergedQuery(ctx *fasthttp.RequestCtx, query, auth string, chunked bool, chunkSize int) {
+	bodies := make([][]byte, 0, len(h.queries))
+	var lastErr error
+	for _, q := range h.queries {
+		resp, err := q.poster.post([]byte{}, query, auth)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		bodies = append(bodies, resp.Body)
+	}
+
+	if len(bodies) == 0 {
+		jsonError(ctx, fasthttp.StatusBadGateway, fmt.Sprintf("all query backends failed: %v", lastErr))
+		return
+	}
+
+	merged, err := mergeQueryResponses(bodies)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "unable to merge backend responses")
+		return
+	}
+
+	if chunked {
+		writeChunkedQueryResponse(ctx, merged, chunkSize)
+		return
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "unable to marshal merged response")
+		return
+	}
+	ctx.SetContentType("application/json")
+	ctx.Write(data)
+}
+
+// broadcastTargets returns the backends a schema-mutating statement must
+// reach. In replicate mode every query backend holds the full data set, so
+// h.queries is enough. Once writes are sharded that's no longer true - a
+// CREATE/DROP/GRANT must land on every shard in h.backends too, or a shard
+// that never saw it will reject (or silently miss) later writes. In
+// shard-and-replicate mode, h.replicas also receive every write directly
+// (see dispatchSharded) and so must see schema statements too.
+func (h *HTTP) broadcastTargets() []*httpBackend {
+	if h.mode == modeReplicate {
+		return h.queries
+	}
+
+	lists := [][]*httpBackend{h.queries, h.backends}
+	if h.mode == modeShardAndReplicate {
+		lists = append(lists, h.replicas)
+	}
+
+	size := 0
+	for _, list := range lists {
+		size += len(list)
+	}
+
+	seen := make(map[*httpBackend]bool, size)
+	targets := make([]*httpBackend, 0, size)
+	for _, list := range lists {
+		for _, b := range list {
+			if seen[b] {
+				continue
+			}
+			seen[b] = true
+			targets = append(targets, b)
+		}
+	}
+	return targets
+}
+
+// broadcastQuery sends a write/DDL statement to every backend that must
+// see it (see broadcastTargets). The relay reports an error (502) only
+// when every target fails, by a transport error or a 5xx response;
+// otherwise it reports success.
+//
+// On success this returns 200 with a synthesized {"results":[...]} body,
+// one empty result per statement, matching the wire contract InfluxDB's
+// own /query handler uses even for schema statements - some clients parse
+// that body and choke on a bare 204.
+func (h *HTTP) broadcastQuery(ctx *fasthttp.RequestCtx, query, auth string, statementCount int) {
+	targets := h.broadcastTargets()
+
+	var lastErr error
+	failed := 0
+	for _, b := range targets {
+		resp, err := b.poster.post([]byte{}, query, auth)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		if resp.StatusCode/100 == 5 {
+			failed++
+		}
+	}
+
+	if failed == len(targets) {
+		jsonError(ctx, fasthttp.StatusBadGateway, fmt.Sprintf("all query backends failed: %v", lastErr))
+		return
+	}
+
+	results := make([]influxQLResult, statementCount)
+	for i := range results {
+		results[i] = influxQLResult{StatementID: i}
+	}
+	data, err := json.Marshal(influxQLResponse{Results: results})
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "unable to marshal response")
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.Write(data)
+}
+
+// mixedQuery executes a query that mixes read and write/DDL statements by
+// routing each statement on its own - a real per-backend response is
+// fetched for every read, and every write/DDL is broadcast - then
+// reassembles the results in the original statement order. Each statement
+// is re-serialized and sent on its own, so a failure in one statement
+// doesn't prevent the others from being reported.
+func (h *HTTP) mixedQuery(ctx *fasthttp.RequestCtx, statements influxql.Statements, auth string, chunked bool, chunkSize int) {
+	results := make([]influxQLResult, len(statements))
+	for i, stmt := range statements {
+		var result influxQLResult
+		var err error
+		if isReadOnlyStatement(stmt) {
+			result, err = h.executeReadStatement(stmt, auth)
+		} else {
+			err = h.executeWriteStatement(stmt, auth)
+		}
+		if err != nil {
+			result = influxQLResult{Err: err.Error()}
+		}
+		result.StatementID = i
+		results[i] = result
+	}
+
+	merged := influxQLResponse{Results: results}
+	if chunked {
+		writeChunkedQueryResponse(ctx, merged, chunkSize)
+		return
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		jsonError(ctx, fasthttp.StatusInternalServerError, "unable to marshal merged response")
+		return
+	}
+	ctx.SetContentType("application/json")
+	ctx.Write(data)
+}
+
+// executeReadStatement runs a single read-only statement and returns its
+// result, merging across every query backend when the answer can
+// legitimately differ per backend (a SHOW, or any read once writes are
+// sharded) and otherwise proxying to one random backend, the same
+// policy serveQuery applies to a whole read-only query.
+func (h *HTTP) executeReadStatement(stmt influxql.Statement, auth string) (influxQLResult, error) {
+	if len(h.queries) == 0 {
+		return influxQLResult{}, fmt.Errorf("no query backends configured")
+	}
+
+	text := stmt.String()
+
+	if isShowStatement(stmt) || h.mode != modeReplicate {
+		bodies := make([][]byte, 0, len(h.queries))
+		var lastErr error
+		for _, q := range h.queries {
+			resp, err := q.poster.post([]byte{}, text, auth)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			bodies = append(bodies, resp.Body)
+		}
+		if len(bodies) == 0 {
+			return influxQLResult{}, fmt.Errorf("all query backends failed: %v", lastErr)
+		}
+
+		merged, err := mergeQueryResponses(bodies)
+		if err != nil || len(merged.Results) == 0 {
+			return influxQLResult{}, fmt.Errorf("unable to merge backend responses")
+		}
+		return merged.Results[0], nil
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	n := rand.Intn(len(h.queries))
+
+	resp, err := h.queries[n].poster.post([]byte{}, text, auth)
+	if err != nil {
+		return influxQLResult{}, fmt.Errorf("request failed")
+	}
+
+	var decoded influxQLResponse
+	if err := json.Unmarshal(resp.Body, &decoded); err != nil || len(decoded.Results) == 0 {
+		return influxQLResult{}, fmt.Errorf("unable to decode backend response")
+	}
+	return decoded.Results[0], nil
+}
+
+// executeWriteStatement broadcasts a single write/DDL statement to every
+// backend broadcastTargets requires it to reach.
+func (h *HTTP) executeWriteStatement(stmt influxql.Statement, auth string) error {
+	targets := h.broadcastTargets()
+	text := stmt.String()
+
+	var lastErr error
+	failed := 0
+	for _, b := range targets {
+		resp, err := b.poster.post([]byte{}, text, auth)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		if resp.StatusCode/100 == 5 {
+			failed++
+		}
+	}
+
+	if failed == len(targets) {
+		return fmt.Errorf("all query backends failed: %v", lastErr)
+	}
+	return nil
+}
+
+func seriesKey(s influxQLSeries) string {
+	tags := make([]string, 0, len(s.Tags))
+	for k, v := range s.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return s.Name + "|" + fmt.Sprint(tags)
+}
+
+// mergeQueryResponses unions the series/rows of multiple backends' query
+// responses per statement, the same way InfluxDB's own httpd handler
+// composes per-shard results.
+func mergeQueryResponses(bodies [][]byte) (influxQLResponse, error) {
+	type seriesAccum struct {
+		series influxQLSeries
+		seen   map[string]bool
+	}
+
+	var statementOrder []int
+	resultByStatement := map[int]*influxQLResult{}
+	seriesOrder := map[int][]string{}
+	seriesByStatement := map[int]map[string]*seriesAccum{}
+
+	for _, body := range bodies {
+		var resp influxQLResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return influxQLResponse{}, err
+		}
+
+		for _, result := range resp.Results {
+			res, ok := resultByStatement[result.StatementID]
+			if !ok {
+				res = &influxQLResult{StatementID: result.StatementID, Err: result.Err}
+				resultByStatement[result.StatementID] = res
+				seriesByStatement[result.StatementID] = map[string]*seriesAccum{}
+				statementOrder = append(statementOrder, result.StatementID)
+			}
+
+			for _, s := range result.Series {
+				key := seriesKey(s)
+				acc, ok := seriesByStatement[result.StatementID][key]
+				if !ok {
+					acc = &seriesAccum{
+						series: influxQLSeries{Name: s.Name, Tags: s.Tags, Columns: s.Columns},
+						seen:   map[string]bool{},
+					}
+					seriesByStatement[result.StatementID][key] = acc
+					seriesOrder[result.StatementID] = append(seriesOrder[result.StatementID], key)
+				}
+
+				for _, row := range s.Values {
+					rowKey := fmt.Sprint(row)
+					if acc.seen[rowKey] {
+						continue
+					}
+					acc.seen[rowKey] = true
+					acc.series.Values = append(acc.series.Values, row)
+				}
+			}
+		}
+	}
+
+	sort.Ints(statementOrder)
+
+	var merged influxQLResponse
+	for _, id := range statementOrder {
+		res := resultByStatement[id]
+		for _, key := range seriesOrder[id] {
+			res.Series = append(res.Series, seriesByStatement[id][key].series)
+		}
+		merged.Results = append(merged.Results, *res)
+	}
+
+	return merged, nil
+}
+
+// writeChunkedQueryResponse streams merged in pages of chunkSize rows per
+// series, flushing after each, rather than buffering the whole response -
+// fasthttp transfers the body chunked automatically once no Content-Length
+// is set and the handler writes through a body stream.
+func writeChunkedQueryResponse(ctx *fasthttp.RequestCtx, merged influxQLResponse, chunkSize int) {
+	ctx.SetContentType("application/json")
+
+	if chunkSize <= 0 {
+		chunkSize = 10000
+	}
+
+	ctx.SetBodyStreamWriter(func(bw *bufio.Writer) {
+		writeChunk := func(result influxQLResult) {
+			data, err := json.Marshal(influxQLResponse{Results: []influxQLResult{result}})
+			if err != nil {
+				return
+			}
+			bw.Write(data)
+			bw.Flush()
+		}
+
+		for _, result := range merged.Results {
+			if len(result.Series) == 0 {
+				writeChunk(influxQLResult{StatementID: result.StatementID, Err: result.Err})
+				continue
+			}
+
+			for _, s := range result.Series {
+				offset := 0
+				for {
+					end := offset + chunkSize
+					partial := end < len(s.Values)
+					if end > len(s.Values) {
+						end = len(s.Values)
+					}
+
+					page := s
+					page.Values = s.Values[offset:end]
+					writeChunk(influxQLResult{StatementID: result.StatementID, Series: []influxQLSeries{page}, Partial: partial})
+
+					if !partial {
+						break
+					}
+					offset = end
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package relay
+
+import "testing"
+
+// TestMergeQueryResponsesDedup verifies mergeQueryResponses unions series
+// and rows across backends (as happens when every query backend holds the
+// same data under modeReplicate, or a disjoint shard of it otherwise)
+// without duplicating a row two backends happen to agree on.
+func TestMergeQueryResponsesDedup(t *testing.T) {
+	bodyA := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,2]]}]}]}`)
+	bodyB := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[2,2],[3,3]]}]}]}`)
+
+	merged, err := mergeQueryResponses([][]byte{bodyA, bodyB})
+	if err != nil {
+		t.Fatalf("mergeQueryResponses: %v", err)
+	}
+
+	if len(merged.Results) != 1 {
+		t.Fatalf("expected 1 merged result, got %d", len(merged.Results))
+	}
+	if len(merged.Results[0].Series) != 1 {
+		t.Fatalf("expected 1 merged series, got %d", len(merged.Results[0].Series))
+	}
+
+	values := merged.Results[0].Series[0].Values
+	if len(values) != 3 {
+		t.Fatalf("expected the overlapping row [2,2] deduped to 3 total rows, got %d: %v", len(values), values)
+	}
+}
+
+// TestMergeQueryResponsesDistinctSeries verifies series that differ by
+// name or tags are kept apart rather than merged into one.
+func TestMergeQueryResponsesDistinctSeries(t *testing.T) {
+	bodyA := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1]]}]}]}`)
+	bodyB := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,2]]}]}]}`)
+
+	merged, err := mergeQueryResponses([][]byte{bodyA, bodyB})
+	if err != nil {
+		t.Fatalf("mergeQueryResponses: %v", err)
+	}
+
+	if len(merged.Results[0].Series) != 2 {
+		t.Fatalf("expected series for host=a and host=b to stay distinct, got %d series", len(merged.Results[0].Series))
+	}
+}
+
+// TestMergeQueryResponsesMultipleStatements verifies results for different
+// statement IDs (as produced by a multi-statement query) are kept in
+// their own buckets and returned in ascending statement order.
+func TestMergeQueryResponsesMultipleStatements(t *testing.T) {
+	bodyA := []byte(`{"results":[{"statement_id":1,"series":[{"name":"mem","columns":["time","value"],"values":[[1,1]]}]},{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]]}]}]}`)
+
+	merged, err := mergeQueryResponses([][]byte{bodyA})
+	if err != nil {
+		t.Fatalf("mergeQueryResponses: %v", err)
+	}
+
+	if len(merged.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(merged.Results))
+	}
+	if merged.Results[0].StatementID != 0 || merged.Results[1].StatementID != 1 {
+		t.Fatalf("expected results ordered by statement ID, got %+v", merged.Results)
+	}
+}
@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// bucketIdleTTL/bucketSweepPeriod bound the memory rateLimiter's per-key
+// bucket maps would otherwise grow without limit as distinct Authorization
+// values and source IPs are seen over the relay's uptime: a bucket that
+// hasn't been touched in bucketIdleTTL is evicted, and a fresh one (full
+// burst) is created if that key shows up again later.
+const (
+	bucketIdleTTL     = 10 * time.Minute
+	bucketSweepPeriod = time.Minute
+)
+
+// tokenBucket is a classic token-bucket limiter: tokens refill at rate
+// per second up to burst, and allow() consumes one token if available.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimitRule is one token-bucket configuration: RatePerSecond tokens
+// are added per second, up to Burst. A zero RatePerSecond means unlimited.
+type rateLimitRule struct {
+	RatePerSecond float64
+	Burst         float64
+}
+
+func (r rateLimitRule) enabled() bool {
+	return r.RatePerSecond > 0
+}
+
+// rateLimiter gates serveWrite admission with one token bucket per
+// Authorization principal and one per source IP - similar to how
+// InfluxDB's own httpd handler gates requests per user/client - plus an
+// optional per-database override of the global rule.
+type rateLimiter struct {
+	global rateLimitRule
+	perDB  map[string]rateLimitRule
+
+	mu     sync.Mutex
+	byAuth map[string]*tokenBucket
+	byIP   map[string]*tokenBucket
+}
+
+func newRateLimiter(global rateLimitRule, perDB map[string]rateLimitRule) *rateLimiter {
+	rl := &rateLimiter{
+		global: global,
+		perDB:  perDB,
+		byAuth: make(map[string]*tokenBucket),
+		byIP:   make(map[string]*tokenBucket),
+	}
+
+	if rl.enabled() {
+		go rl.sweepIdleBuckets()
+	}
+
+	return rl
+}
+
+// sweepIdleBuckets periodically evicts buckets that haven't been touched
+// in bucketIdleTTL, bounding byAuth/byIP to the set of currently-active
+// principals/IPs rather than every one ever seen.
+func (rl *rateLimiter) sweepIdleBuckets() {
+	ticker := time.NewTicker(bucketSweepPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rl.evictIdle(rl.byAuth)
+		rl.evictIdle(rl.byIP)
+	}
+}
+
+func (rl *rateLimiter) evictIdle(buckets map[string]*tokenBucket) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range buckets {
+		b.mu.Lock()
+		idle := now.Sub(b.last)
+		b.mu.Unlock()
+
+		if idle > bucketIdleTTL {
+			delete(buckets, key)
+		}
+	}
+}
+
+// enabled reports whether any limiting is configured at all, so callers
+// can skip the admission check entirely in the common unconfigured case.
+func (rl *rateLimiter) enabled() bool {
+	if rl == nil {
+		return false
+	}
+	if rl.global.enabled() {
+		return true
+	}
+	for _, rule := range rl.perDB {
+		if rule.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func (rl *rateLimiter) ruleFor(db string) rateLimitRule {
+	if rule, ok := rl.perDB[db]; ok {
+		return rule
+	}
+	return rl.global
+}
+
+func (rl *rateLimiter) bucket(buckets map[string]*tokenBucket, key string, rule rateLimitRule) *tokenBucket {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := buckets[key]
+	if !ok {
+		b = newTokenBucket(rule.RatePerSecond, rule.Burst)
+		buckets[key] = b
+	}
+	return b
+}
+
+// allow reports whether a write for db, from auth principal and source
+// ip, is admitted. Both the per-principal and per-IP buckets must have a
+// token available.
+func (rl *rateLimiter) allow(db, auth, ip string) bool {
+	if rl == nil {
+		return true
+	}
+
+	rule := rl.ruleFor(db)
+	if !rule.enabled() {
+		return true
+	}
+
+	// A database with an override gets its own buckets, so the override
+	// applies to that database only and the global pool is left alone.
+	scope := ""
+	if _, ok := rl.perDB[db]; ok {
+		scope = "db:" + db + "|"
+	}
+
+	if auth != "" {
+		if !rl.bucket(rl.byAuth, scope+"auth:"+auth, rule).allow() {
+			return false
+		}
+	}
+	if ip != "" {
+		if !rl.bucket(rl.byIP, scope+"ip:"+ip, rule).allow() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTokenBucketBurstAndRefill verifies a bucket allows exactly burst
+// requests back to back, then refills deterministically once its clock
+// (last) shows time has passed - using the bucket's own fields rather
+// than a real sleep, so the math is asserted exactly and the test stays
+// fast and flake-free.
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	b := newTokenBucket(1 /* rate/sec */, 3 /* burst */)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("expected burst request %d to be allowed", i)
+		}
+	}
+	if b.allow() {
+		t.Fatalf("expected burst to be exhausted")
+	}
+
+	// Back-date last by 2 seconds to simulate 2 seconds of elapsed time
+	// without an actual sleep; at rate=1/sec that refills 2 tokens.
+	b.mu.Lock()
+	b.last = b.last.Add(-2 * time.Second)
+	b.mu.Unlock()
+
+	if !b.allow() {
+		t.Fatalf("expected a refilled token to be allowed")
+	}
+	if !b.allow() {
+		t.Fatalf("expected a second refilled token to be allowed")
+	}
+	if b.allow() {
+		t.Fatalf("expected only 2 tokens to have refilled, got a 3rd allowed request")
+	}
+}
+
+// TestTokenBucketRefillClampedToBurst verifies tokens never accumulate
+// past burst even after a long idle period.
+func TestTokenBucketRefillClampedToBurst(t *testing.T) {
+	b := newTokenBucket(100, 2)
+
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+
+	if !b.allow() || !b.allow() {
+		t.Fatalf("expected both burst tokens to be allowed after a long idle period")
+	}
+	if b.allow() {
+		t.Fatalf("expected refill to be clamped at burst, not unbounded")
+	}
+}
+
+// TestRateLimiterAllowPerAuthAndPerIP verifies allow requires a token from
+// both the per-Authorization and per-IP buckets: a fresh pair is admitted,
+// but exhausting either bucket alone is enough to deny, regardless of
+// what the other one looks like.
+func TestRateLimiterAllowPerAuthAndPerIP(t *testing.T) {
+	rl := newRateLimiter(rateLimitRule{RatePerSecond: 1, Burst: 1}, nil)
+
+	if !rl.allow("db", "auth-a", "1.1.1.1") {
+		t.Fatalf("expected the first request for auth-a/1.1.1.1 to be allowed")
+	}
+	if rl.allow("db", "auth-a", "1.1.1.1") {
+		t.Fatalf("expected the second immediate request for the same auth+IP to be denied")
+	}
+	if !rl.allow("db", "auth-b", "2.2.2.2") {
+		t.Fatalf("expected a fresh auth+IP pair to have its own buckets")
+	}
+	if rl.allow("db", "auth-a", "3.3.3.3") {
+		t.Fatalf("expected the exhausted auth bucket to still deny, regardless of IP")
+	}
+	if rl.allow("db", "auth-c", "1.1.1.1") {
+		t.Fatalf("expected the exhausted IP bucket to still deny, regardless of auth")
+	}
+}
+
+// TestRateLimiterDisabledAllowsEverything verifies a zero-value rule (no
+// RatePerSecond configured) disables admission control entirely, for both
+// a nil limiter and one with an unconfigured global rule.
+func TestRateLimiterDisabledAllowsEverything(t *testing.T) {
+	var nilLimiter *rateLimiter
+	if !nilLimiter.allow("db", "auth", "1.1.1.1") {
+		t.Fatalf("expected a nil rateLimiter to allow everything")
+	}
+
+	rl := newRateLimiter(rateLimitRule{}, nil)
+	if rl.enabled() {
+		t.Fatalf("expected an unconfigured rule to report disabled")
+	}
+	for i := 0; i < 5; i++ {
+		if !rl.allow("db", "auth", "1.1.1.1") {
+			t.Fatalf("expected an unconfigured limiter to allow every request")
+		}
+	}
+}
+
+// TestRateLimiterPerDatabaseOverride verifies a per-database rule takes
+// precedence over the global rule for that database only.
+func TestRateLimiterPerDatabaseOverride(t *testing.T) {
+	rl := newRateLimiter(
+		rateLimitRule{RatePerSecond: 1, Burst: 100},
+		map[string]rateLimitRule{"strict": {RatePerSecond: 1, Burst: 1}},
+	)
+
+	if !rl.allow("strict", "auth", "1.1.1.1") {
+		t.Fatalf("expected the first request against the strict db to be allowed")
+	}
+	if rl.allow("strict", "auth", "1.1.1.1") {
+		t.Fatalf("expected the strict db's burst of 1 to reject a second immediate request")
+	}
+
+	// A database with no override falls back to the global rule, whose
+	// burst of 100 easily admits a first request from a fresh auth/IP.
+	if !rl.allow("other", "auth2", "2.2.2.2") {
+		t.Fatalf("expected an unlisted database to fall back to the global rule")
+	}
+}
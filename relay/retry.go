@@ -1,10 +1,12 @@
 package relay
 
 import (
-	"time"
-	"net/http"
-	"log"
 	"bytes"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -12,12 +14,82 @@ const (
 	retryMultiplier = 2
 )
 
+// defaultLatencyBucketsMS are the upper bounds, in milliseconds, of the
+// per-backend delivery-latency histogram served on /debug/relay.
+var defaultLatencyBucketsMS = []float64{1, 5, 10, 50, 100, 500, 1000, 5000}
+
+// latencyHistogram is a small fixed-bucket histogram tracking how long
+// postToInfluxDB takes to either deliver or give up on a batch.
+type latencyHistogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		buckets: defaultLatencyBucketsMS,
+		counts:  make([]int64, len(defaultLatencyBucketsMS)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += ms
+	for i, upper := range h.buckets {
+		if ms <= upper {
+			h.counts[i]++
+			return
+		}
+	}
+	h.counts[len(h.counts)-1]++
+}
+
+// latencySnapshot is the JSON-serializable view of a latencyHistogram.
+type latencySnapshot struct {
+	Count         int64
+	MeanMS        float64
+	BucketUpperMS []float64
+	BucketCounts  []int64
+}
+
+func (h *latencyHistogram) snapshot() latencySnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make([]int64, len(h.counts))
+	copy(counts, h.counts)
+
+	var mean float64
+	if h.count > 0 {
+		mean = h.sum / float64(h.count)
+	}
+
+	return latencySnapshot{
+		Count:         h.count,
+		MeanMS:        mean,
+		BucketUpperMS: h.buckets,
+		BucketCounts:  counts,
+	}
+}
+
 type Operation func() error
 
 type batchPoints struct {
 	Query string
 	Auth  string
 	Data  []byte
+
+	// Ref is set when this batch was journaled to a diskWAL; the retry
+	// loop releases it once the batch has been delivered or dropped.
+	Ref *walSegmentRef
 }
 
 type cachedPoints struct {
@@ -26,6 +98,30 @@ type cachedPoints struct {
 	Buf     bytes.Buffer
 	BufSize int
 	Time    time.Time // create time of this cachedPoints
+
+	// walRefs tracks, per WAL segment this batch drew entries from, how
+	// many of those entries it is carrying. It is nil when the backend
+	// has no WAL configured.
+	walRefs map[*walSegmentRef]int64
+}
+
+func (c *cachedPoints) addWALRef(ref *walSegmentRef) {
+	if ref == nil {
+		return
+	}
+	if c.walRefs == nil {
+		c.walRefs = make(map[*walSegmentRef]int64)
+	}
+	c.walRefs[ref]++
+}
+
+// releaseWAL tells the WAL that every entry this cached batch carried has
+// either been delivered or permanently given up on, so the owning
+// segment(s) can be truncated once fully acknowledged.
+func (c *cachedPoints) releaseWAL() {
+	for ref, n := range c.walRefs {
+		ref.release(n)
+	}
 }
 
 // Buffers and retries operations, if the buffer is full operations are dropped.
@@ -43,31 +139,90 @@ type retryBuffer struct {
 	cachedItems []*cachedPoints // cachedPoints
 	itemChan    chan batchPoints
 
+	wal *diskWAL
+
+	// highWaterMark is the queued-bytes threshold above which post()
+	// stops admitting new writes and returns ErrBufferFull instead of
+	// blocking, so a stalled backend can't back up into serveWrite and
+	// make the relay itself unresponsive. Zero disables the check (the
+	// itemChan's fixed capacity is still a non-blocking backstop).
+	highWaterMark int64
+	pendingBytes  int64 // atomic; bytes currently queued in itemChan/cachedItems
+	dropped       int64 // atomic; writes rejected by post() for this backend
+
+	latency *latencyHistogram
+
 	p poster
 }
 
-func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
+// newRetryBuffer creates a retryBuffer for p. When walDir is non-empty,
+// writes are journaled to a diskWAL under walDir before being queued, and
+// any WAL segments left over from a previous run are replayed before the
+// backend accepts new traffic. highWaterMark is the queued-bytes backpressure
+// threshold (see retryBuffer.highWaterMark); zero disables it.
+func newRetryBuffer(size, batch int, max time.Duration, p poster, walDir string, highWaterMark int64) (*retryBuffer, error) {
 	r := &retryBuffer{
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
 		maxInterval:     max,
 		maxBuffered:     size,
 		maxBatch:        batch,
+		highWaterMark:   highWaterMark,
+		latency:         newLatencyHistogram(),
 		p:               p,
 		cachedItems:     make([]*cachedPoints, 0),
 		itemChan:        make(chan batchPoints, 10000),
 	}
+
+	if walDir != "" {
+		wal, err := newDiskWAL(walDir)
+		if err != nil {
+			return nil, err
+		}
+		r.wal = wal
+
+		pending, err := wal.replayPending()
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range pending {
+			r.addToCache(rec.batchPoints, rec.ref)
+			atomic.AddInt64(&r.pendingBytes, int64(len(rec.Data)))
+		}
+	}
+
 	go r.run()
-	return r
+	return r, nil
 }
 
 func (r *retryBuffer) post(buf []byte, query string, auth string) (*responseData, error) {
+	if r.highWaterMark > 0 && atomic.LoadInt64(&r.pendingBytes) >= r.highWaterMark {
+		atomic.AddInt64(&r.dropped, 1)
+		return nil, ErrBufferFull
+	}
+
+	var ref *walSegmentRef
+	if r.wal != nil {
+		var err error
+		ref, err = r.wal.append(query, auth, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// direct pass to chan
-	r.itemChan <- batchPoints{
-		Query: query,
-		Auth:  auth,
-		Data:  buf,
+	// Non-blocking send: a stalled backend must not back up into
+	// serveWrite and stall the relay itself. If the channel (already a
+	// fixed-capacity backstop) is full, give up on this write rather
+	// than block.
+	select {
+	case r.itemChan <- batchPoints{Query: query, Auth: auth, Data: buf, Ref: ref}:
+		atomic.AddInt64(&r.pendingBytes, int64(len(buf)))
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+		if ref != nil {
+			ref.release(1)
+		}
+		return nil, ErrBufferFull
 	}
 
 	return &responseData{
@@ -76,59 +231,76 @@ func (r *retryBuffer) post(buf []byte, query string, auth string) (*responseData
 	}, nil
 }
 
-func (r *retryBuffer) run() {
-	addToCache := func(points *batchPoints) {
-		addToCachedFlag := false
-		for _, cached := range r.cachedItems {
-			if cached.Auth == points.Auth && cached.Query == points.Query {
-				cached.Buf.Write(points.Data)
-				cached.BufSize += len(points.Data)
-				addToCachedFlag = true
-				break
-			}
-		}
-		if addToCachedFlag == false {
-			cached := cachedPoints{
-				Query:   points.Query,
-				Auth:    points.Auth,
-				Time:    time.Now(),
-				Buf:     *bytes.NewBuffer([]byte{}),
-				BufSize: 0,
-			}
-			r.cachedItems = append(r.cachedItems, &cached)
+// stats reports the queue depth, dropped-write count and delivery-latency
+// histogram, and, when a WAL is configured, the on-disk backlog behind this
+// backend. It backs the relay's /metrics and /debug/relay endpoints.
+func (r *retryBuffer) stats() walMetrics {
+	m := walMetrics{
+		PendingItems: len(r.itemChan),
+		QueuedBytes:  atomic.LoadInt64(&r.pendingBytes),
+		Dropped:      atomic.LoadInt64(&r.dropped),
+		Latency:      r.latency.snapshot(),
+	}
+	if r.wal != nil {
+		m.PendingBytes = r.wal.pendingBytes()
+		m.OldestSegmentAge = r.wal.oldestSegmentAge()
+	}
+	return m
+}
+
+func (r *retryBuffer) addToCache(points batchPoints, ref *walSegmentRef) {
+	for _, cached := range r.cachedItems {
+		if cached.Auth == points.Auth && cached.Query == points.Query {
+			cached.Buf.Write(points.Data)
+			cached.BufSize += len(points.Data)
+			cached.addWALRef(ref)
+			return
 		}
 	}
 
-	postToInfluxDB := func(data []byte, query string, auth string) {
-		interval := r.initialInterval
-		maxInterval := r.maxInterval
-		for {
-			resp, err := r.p.post(data, query, auth)
-			if err == nil && resp.StatusCode/100 != 5 {
-				log.Print("send data: ", len(data))
-				break
-			} else if interval >= maxInterval {
-				// resp.StatusCode == 5xx
-				// this prevent the forever loop of InfluxDB server return 5xx
-				log.Print("lost data: ", string(data))
-				break
-			}
+	cached := &cachedPoints{
+		Query:   points.Query,
+		Auth:    points.Auth,
+		Time:    time.Now(),
+		Buf:     *bytes.NewBuffer([]byte{}),
+		BufSize: len(points.Data),
+	}
+	cached.Buf.Write(points.Data)
+	cached.addWALRef(ref)
+	r.cachedItems = append(r.cachedItems, cached)
+}
 
-			if interval <= maxInterval {
-				interval *= r.multiplier
-				if interval > maxInterval {
-					interval = maxInterval
-				}
-			}
+func (r *retryBuffer) postToInfluxDB(data []byte, query string, auth string) {
+	interval := r.initialInterval
+	maxInterval := r.maxInterval
+	for {
+		resp, err := r.p.post(data, query, auth)
+		if err == nil && resp.StatusCode/100 != 5 {
+			log.Print("send data: ", len(data))
+			return
+		} else if interval >= maxInterval {
+			// resp.StatusCode == 5xx
+			// this prevent the forever loop of InfluxDB server return 5xx
+			log.Print("lost data: ", string(data))
+			return
+		}
 
-			time.Sleep(interval)
+		if interval <= maxInterval {
+			interval *= r.multiplier
+			if interval > maxInterval {
+				interval = maxInterval
+			}
 		}
+
+		time.Sleep(interval)
 	}
+}
 
+func (r *retryBuffer) run() {
 	for {
 		select {
 		case points := <-r.itemChan:
-			addToCache(&points)
+			r.addToCache(points, points.Ref)
 		default:
 			time.Sleep(10 * time.Millisecond)
 		}
@@ -139,8 +311,15 @@ func (r *retryBuffer) run() {
 				// remove cached from r.cachedItems
 				r.cachedItems = append(r.cachedItems[:index], r.cachedItems[index+1:]...)
 
-				// send removed item to InfluxDB server
-				postToInfluxDB(cached.Buf.Bytes(), cached.Query, cached.Auth)
+				// send removed item to InfluxDB server, then truncate its
+				// WAL range and release its share of pendingBytes
+				// regardless of whether it was delivered or dropped after
+				// exhausting retries
+				deliverStart := time.Now()
+				r.postToInfluxDB(cached.Buf.Bytes(), cached.Query, cached.Auth)
+				r.latency.observe(time.Since(deliverStart))
+				cached.releaseWAL()
+				atomic.AddInt64(&r.pendingBytes, -int64(cached.BufSize))
 			}
 		}
 	}
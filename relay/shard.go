@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// outputMode governs how serveWrite fans a write out across h.backends.
+type outputMode int
+
+const (
+	// modeReplicate sends every point to every backend. This is the
+	// original, default behavior.
+	modeReplicate outputMode = iota
+	// modeShard routes each point to exactly replicationFactor backends,
+	// chosen by a rendezvous (HRW) hash of its series key, for
+	// horizontal sharding instead of replication.
+	modeShard
+	// modeShardAndReplicate routes like modeShard, and additionally
+	// fires the same write at every backend in h.replicas.
+	modeShardAndReplicate
+)
+
+func parseOutputMode(mode string) (outputMode, error) {
+	switch mode {
+	case "", "replicate":
+		return modeReplicate, nil
+	case "shard":
+		return modeShard, nil
+	case "shard-and-replicate":
+		return modeShardAndReplicate, nil
+	default:
+		return modeReplicate, fmt.Errorf("unknown output mode %q", mode)
+	}
+}
+
+// rendezvousRank orders backends by descending HRW (highest random weight)
+// score for key, so the first n entries are the stable set of targets key
+// hashes to - the same backends every time, regardless of the order they
+// were configured in. Adding or removing a backend moves only that backend
+// within a key's ranking; the relative order of the others is unchanged.
+func rendezvousRank(backends []*httpBackend, key string) []*httpBackend {
+	type scored struct {
+		backend *httpBackend
+		weight  uint64
+	}
+
+	scores := make([]scored, len(backends))
+	for i, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(b.name))
+		scores[i] = scored{backend: b, weight: h.Sum64()}
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].weight > scores[j].weight
+	})
+
+	ranked := make([]*httpBackend, len(scores))
+	for i, s := range scores {
+		ranked[i] = s.backend
+	}
+	return ranked
+}
+
+// shardKey is the rendezvous hash input for a point: its database,
+// retention policy, measurement and tag set, so every write for a given
+// series always lands on the same shard targets. Point tags are already
+// stored sorted by key, so no extra sorting is needed here.
+func shardKey(db, rp string, p models.Point) string {
+	var buf bytes.Buffer
+	buf.WriteString(db)
+	buf.WriteByte('|')
+	buf.WriteString(rp)
+	buf.WriteByte('|')
+	buf.Write(p.Name())
+	for _, t := range p.Tags() {
+		buf.WriteByte('|')
+		buf.Write(t.Key)
+		buf.WriteByte('=')
+		buf.Write(t.Value)
+	}
+	return buf.String()
+}
+
+// shardTargets returns the stable set of replicationFactor backends that
+// key hashes to.
+func (h *HTTP) shardTargets(key string) []*httpBackend {
+	ranked := rendezvousRank(h.backends, key)
+	n := h.replicationFactor
+	if n > len(ranked) {
+		n = len(ranked)
+	}
+	return ranked[:n]
+}
+
+func targetsKey(targets []*httpBackend) string {
+	names := make([]string, len(targets))
+	for i, b := range targets {
+		names[i] = b.name
+	}
+	return strings.Join(names, ",")
+}
+
+// dispatchSharded groups points by the shard targets they hash to and
+// dispatches one chunk per group, so a retry lands on exactly the nodes
+// that point was originally routed to. In shard-and-replicate mode it also
+// fires an async copy of every point at h.replicas.
+func (h *HTTP) dispatchSharded(points []models.Point, precision, db, rp, query, auth string, dispatch func([]byte, []*httpBackend)) {
+	type group struct {
+		targets []*httpBackend
+		buf     bytes.Buffer
+	}
+
+	groups := make(map[string]*group)
+	var order []string
+
+	for _, p := range points {
+		targets := h.shardTargets(shardKey(db, rp, p))
+		gk := targetsKey(targets)
+
+		g, ok := groups[gk]
+		if !ok {
+			g = &group{targets: targets}
+			groups[gk] = g
+			order = append(order, gk)
+		}
+
+		g.buf.WriteString(p.PrecisionString(precision))
+		g.buf.WriteByte('\n')
+	}
+
+	for _, gk := range order {
+		g := groups[gk]
+		buf := make([]byte, g.buf.Len())
+		copy(buf, g.buf.Bytes())
+		dispatch(buf, g.targets)
+	}
+
+	if h.mode == modeShardAndReplicate && len(h.replicas) > 0 {
+		var replicaBuf bytes.Buffer
+		for _, p := range points {
+			replicaBuf.WriteString(p.PrecisionString(precision))
+			replicaBuf.WriteByte('\n')
+		}
+		data := replicaBuf.Bytes()
+
+		for _, b := range h.replicas {
+			b := b
+			go func() {
+				if _, err := b.post(data, query, auth); err != nil {
+					log.Printf("Problem posting replica copy to relay backend %q: %v", b.name, err)
+				}
+			}()
+		}
+	}
+}
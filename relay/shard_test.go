@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"testing"
+)
+
+func namedBackends(names ...string) []*httpBackend {
+	backends := make([]*httpBackend, len(names))
+	for i, n := range names {
+		backends[i] = &httpBackend{name: n}
+	}
+	return backends
+}
+
+// TestRendezvousRankStable verifies the core HRW property that sharding
+// depends on: the ranking for a given key does not depend on the order
+// backends were passed in. Removing a backend is covered separately by
+// TestRendezvousRankMinimalDisruption.
+func TestRendezvousRankStable(t *testing.T) {
+	backends := namedBackends("a", "b", "c", "d")
+
+	rankA := rendezvousRank(backends, "mydb|myrp|cpu|host=web1")
+
+	shuffled := []*httpBackend{backends[2], backends[0], backends[3], backends[1]}
+	rankB := rendezvousRank(shuffled, "mydb|myrp|cpu|host=web1")
+
+	if len(rankA) != len(rankB) {
+		t.Fatalf("rank length mismatch: %d vs %d", len(rankA), len(rankB))
+	}
+	for i := range rankA {
+		if rankA[i].name != rankB[i].name {
+			t.Fatalf("rank order depends on input order at index %d: %q vs %q", i, rankA[i].name, rankB[i].name)
+		}
+	}
+}
+
+// TestRendezvousRankMinimalDisruption verifies that removing one backend
+// only reshuffles the keys that were mapped to it - keys mapped to other
+// backends keep their top choice, which is the whole point of using HRW
+// instead of e.g. mod-N hashing for a shard target set.
+func TestRendezvousRankMinimalDisruption(t *testing.T) {
+	full := namedBackends("a", "b", "c", "d", "e")
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = shardKeyFromInt(i)
+	}
+
+	top := make(map[string]string, len(keys))
+	for _, k := range keys {
+		top[k] = rendezvousRank(full, k)[0].name
+	}
+
+	reduced := namedBackends("a", "b", "c", "d") // "e" removed
+
+	changed, unchanged := 0, 0
+	for _, k := range keys {
+		newTop := rendezvousRank(reduced, k)[0].name
+		if top[k] == "e" {
+			continue // these keys must move somewhere; not under test here
+		}
+		if newTop == top[k] {
+			unchanged++
+		} else {
+			changed++
+		}
+	}
+
+	if changed != 0 {
+		t.Fatalf("removing an unrelated backend changed top choice for %d keys that weren't on it (should be 0, only keys on the removed backend may move)", changed)
+	}
+	if unchanged == 0 {
+		t.Fatalf("test fixture produced no keys mapped away from the removed backend; strengthen it")
+	}
+}
+
+func shardKeyFromInt(i int) string {
+	return "db|rp|measurement|tag=" + string(rune('a'+i%26)) + string(rune('0'+i/26))
+}
+
+// TestShardTargetsStableSize verifies shardTargets always returns exactly
+// replicationFactor backends (or fewer, only once there are fewer backends
+// configured than the factor).
+func TestShardTargetsStableSize(t *testing.T) {
+	h := &HTTP{backends: namedBackends("a", "b", "c"), replicationFactor: 2}
+
+	targets := h.shardTargets("db|rp|m|t=v")
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 shard targets, got %d", len(targets))
+	}
+
+	h.replicationFactor = 10
+	targets = h.shardTargets("db|rp|m|t=v")
+	if len(targets) != len(h.backends) {
+		t.Fatalf("replicationFactor above backend count should clamp to %d, got %d", len(h.backends), len(targets))
+	}
+}
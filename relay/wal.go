@@ -0,0 +1,307 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWALSegmentBytes is the rotation size for a WAL segment file.
+const defaultWALSegmentBytes = 64 * MB
+
+// walMetrics is the per-backend queue snapshot served on /metrics and
+// /debug/relay. PendingBytes/OldestSegmentAge describe the on-disk WAL
+// backlog (zero when the backend has no WAL); QueuedBytes/Dropped/Latency
+// describe the in-memory retryBuffer regardless of WAL configuration.
+type walMetrics struct {
+	PendingItems     int
+	PendingBytes     int64
+	OldestSegmentAge time.Duration
+
+	QueuedBytes int64
+	Dropped     int64
+	Latency     latencySnapshot
+}
+
+// walSegmentRef tracks how many WAL entries sourced from one segment file
+// are still waiting to be durably delivered downstream. The segment is
+// only removed from disk once it is BOTH sealed (rotated out, so nothing
+// will ever append to it again) and fully acknowledged (pending has
+// dropped to zero) - pending alone is not enough, since the still-active
+// segment's ref is shared by every append() to it and would otherwise hit
+// zero the instant a healthy backend catches up, deleting a file it is
+// still writing to.
+type walSegmentRef struct {
+	path    string
+	pending int64
+	sealed  int32 // atomic bool; set once this segment is no longer the active write target
+}
+
+// seal marks the segment as rotated out. Call once, from rotate(), after
+// the file has been fsynced and closed.
+func (s *walSegmentRef) seal() {
+	atomic.StoreInt32(&s.sealed, 1)
+	s.removeIfDone()
+}
+
+func (s *walSegmentRef) release(n int64) {
+	atomic.AddInt64(&s.pending, -n)
+	s.removeIfDone()
+}
+
+func (s *walSegmentRef) removeIfDone() {
+	if atomic.LoadInt32(&s.sealed) != 0 && atomic.LoadInt64(&s.pending) <= 0 {
+		os.Remove(s.path)
+	}
+}
+
+// diskWAL is a segmented, append-only write-ahead log that backs a
+// retryBuffer so queued batches survive a relay crash or restart.
+// Segments are fsynced on rotation rather than per write, trading a
+// slightly larger crash-loss window for steady-state throughput.
+type diskWAL struct {
+	mu sync.Mutex
+
+	dir        string
+	maxSegment int64
+
+	seq    int
+	cur    *os.File
+	size   int64
+	curRef *walSegmentRef
+}
+
+func newDiskWAL(dir string) (*diskWAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &diskWAL{dir: dir, maxSegment: defaultWALSegmentBytes}
+
+	existing, err := w.segmentPaths()
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		seq, err := segmentSeq(existing[len(existing)-1])
+		if err != nil {
+			return nil, err
+		}
+		w.seq = seq
+	}
+
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *diskWAL) segmentPaths() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(w.dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func segmentSeq(path string) (int, error) {
+	var seq int
+	base := strings.TrimSuffix(filepath.Base(path), ".wal")
+	if _, err := fmt.Sscanf(base, "%08d", &seq); err != nil {
+		return 0, fmt.Errorf("malformed WAL segment name %q: %v", path, err)
+	}
+	return seq, nil
+}
+
+func (w *diskWAL) segmentPath(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d.wal", seq))
+}
+
+// rotate fsyncs and closes the current segment, if any, and opens a fresh,
+// empty one to write to.
+func (w *diskWAL) rotate() error {
+	if w.cur != nil {
+		if err := w.cur.Sync(); err != nil {
+			return err
+		}
+		if err := w.cur.Close(); err != nil {
+			return err
+		}
+	}
+	if w.curRef != nil {
+		w.curRef.seal()
+	}
+
+	w.seq++
+	path := w.segmentPath(w.seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.cur = f
+	w.size = 0
+	w.curRef = &walSegmentRef{path: path}
+	return nil
+}
+
+// append writes one WAL record and returns the segment reference the
+// caller must release() once the entry has been durably delivered (or
+// permanently given up on).
+func (w *diskWAL) append(query, auth string, data []byte) (*walSegmentRef, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := writeWALRecord(w.cur, query, auth, data)
+	if err != nil {
+		return nil, err
+	}
+	w.size += int64(n)
+
+	ref := w.curRef
+	atomic.AddInt64(&ref.pending, 1)
+
+	if w.size >= w.maxSegment {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ref, nil
+}
+
+func writeWALRecord(f *os.File, query, auth string, data []byte) (int, error) {
+	var hdr [12]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(query)))
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(len(auth)))
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(data)))
+
+	n := 0
+	for _, b := range [][]byte{hdr[:], []byte(query), []byte(auth), data} {
+		m, err := f.Write(b)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// walRecord is one replayed entry paired with the segment it came from, so
+// the caller can release() it once it has been redelivered.
+type walRecord struct {
+	batchPoints
+	ref *walSegmentRef
+}
+
+// replayPending reads every segment other than the one currently being
+// written to and returns their entries in append order. It is called once,
+// from newRetryBuffer, before the backend accepts new traffic.
+func (w *diskWAL) replayPending() ([]walRecord, error) {
+	paths, err := w.segmentPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []walRecord
+	for _, path := range paths {
+		if w.cur != nil && path == w.cur.Name() {
+			continue
+		}
+
+		entries, err := readWALSegment(path)
+		if err != nil {
+			return nil, fmt.Errorf("replaying WAL segment %s: %v", path, err)
+		}
+		if len(entries) == 0 {
+			os.Remove(path)
+			continue
+		}
+
+		// Replayed segments are, by construction, not the active segment
+		// (the loop above skips w.cur), so they're already sealed.
+		ref := &walSegmentRef{path: path, pending: int64(len(entries)), sealed: 1}
+		for _, e := range entries {
+			records = append(records, walRecord{batchPoints: e, ref: ref})
+		}
+	}
+
+	return records, nil
+}
+
+// readWALSegment decodes every whole record in a segment file. A truncated
+// trailing record (the tell-tale sign of a crash mid-write) is dropped
+// rather than treated as corruption of the whole segment.
+func readWALSegment(path string) ([]batchPoints, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var entries []batchPoints
+	for {
+		var hdr [12]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+
+		query := make([]byte, binary.BigEndian.Uint32(hdr[0:4]))
+		auth := make([]byte, binary.BigEndian.Uint32(hdr[4:8]))
+		data := make([]byte, binary.BigEndian.Uint32(hdr[8:12]))
+
+		if _, err := io.ReadFull(r, query); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(r, auth); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		entries = append(entries, batchPoints{Query: string(query), Auth: string(auth), Data: data})
+	}
+
+	return entries, nil
+}
+
+// pendingBytes and oldestSegmentAge back the /metrics endpoint.
+func (w *diskWAL) pendingBytes() int64 {
+	paths, err := w.segmentPaths()
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+func (w *diskWAL) oldestSegmentAge() time.Duration {
+	paths, err := w.segmentPaths()
+	if err != nil || len(paths) == 0 {
+		return 0
+	}
+
+	fi, err := os.Stat(paths[0])
+	if err != nil {
+		return 0
+	}
+	return time.Since(fi.ModTime())
+}
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// recordingPoster is a fake poster that always succeeds and records the
+// chunks it was handed, so a test can assert on what serveWrite actually
+// dispatched rather than just on the HTTP response it returned.
+type recordingPoster struct {
+	mu     sync.Mutex
+	chunks [][]byte
+}
+
+func (p *recordingPoster) post(data []byte, query, auth string) (*responseData, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	p.chunks = append(p.chunks, cp)
+	return &responseData{StatusCode: fasthttp.StatusNoContent}, nil
+}
+
+func (p *recordingPoster) numChunks() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.chunks)
+}
+
+// TestServeWritePartialAcceptOnBadLineInLaterChunk guards serveWrite's
+// partial-write semantics: a bad line in a later chunk must not roll back
+// the chunks already dispatched ahead of it, and the reported error must
+// point at the bad line's real position in the whole request body, not
+// just its position within the chunk that contained it.
+func TestServeWritePartialAcceptOnBadLineInLaterChunk(t *testing.T) {
+	rp := &recordingPoster{}
+	h := &HTTP{
+		backends:          []*httpBackend{{poster: rp, name: "b0"}},
+		mode:              modeReplicate,
+		replicationFactor: 1,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &fasthttp.Server{Handler: h.requestHandler, StreamRequestBody: true}
+	go server.Serve(ln)
+	defer server.Shutdown()
+
+	// Enough valid lines to blow past maxStreamChunkBytes more than
+	// once, so at least two chunks are flushed and dispatched to the
+	// backend before the bad line below is ever reached.
+	const numValidLines = 60000
+	var body bytes.Buffer
+	for i := 0; i < numValidLines; i++ {
+		fmt.Fprintf(&body, "cpu,host=a value=%d 1\n", i)
+	}
+	body.WriteString("not valid line protocol\n")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/write?db=test", ln.Addr().String()), "text/plain", &body)
+	if err != nil {
+		t.Fatalf("POST /write: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+
+	wantPrefix := fmt.Sprintf("partial write: lines 1-%d accepted", numValidLines)
+	if !strings.Contains(string(data), wantPrefix) {
+		t.Fatalf("expected error to report %q, got %q", wantPrefix, string(data))
+	}
+
+	if rp.numChunks() < 2 {
+		t.Fatalf("expected at least 2 chunks dispatched ahead of the bad line, got %d", rp.numChunks())
+	}
+}